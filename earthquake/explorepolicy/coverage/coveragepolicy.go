@@ -0,0 +1,461 @@
+// Copyright (C) 2015 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package coverage provides a coverage-guided policy that biases its
+// decisions toward (entity, event-class, recent-action-history) tuples
+// that have been rarely exercised so far, in the style of AFL-style
+// feedback fuzzing.
+package coverage
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/cihub/seelog"
+	"github.com/osrg/earthquake/earthquake/historystorage"
+	"github.com/osrg/earthquake/earthquake/signal"
+	"github.com/osrg/earthquake/earthquake/util/config"
+	queue "github.com/osrg/earthquake/earthquake/util/queue"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ringSize is the number of past actions remembered per entity when
+// computing the coverage bucket digest.
+const ringSize = 8
+
+const bucketsFileName = "coverage_buckets.json"
+
+// saturating counter cap, same idea as afl-fuzz's hit count buckets
+const counterMax = 255
+
+type Coverage struct {
+	// channel
+	nextActionChan chan signal.Action
+
+	// queue
+	queue      queue.TimeBoundedQueue
+	queueDeqCh chan queue.TimeBoundedQueueItem
+
+	// shell action routine
+	shelActionRoutineRunning bool
+
+	// parameter "minInterval"
+	MinInterval time.Duration
+
+	// parameter "maxInterval"
+	MaxInterval time.Duration
+
+	// parameter "prioritizedEntities"
+	PrioritizedEntities map[string]bool
+
+	// parameter "shellActionInterval"
+	ShellActionInterval time.Duration
+
+	// parameter "shellActionCommand"
+	ShellActionCommand string
+
+	// parameter "faultActionProbability"
+	FaultActionProbability float64
+
+	mutex sync.Mutex
+
+	// rng is used to break bucket-count ties via FaultActionProbability.
+	rng *rand.Rand
+
+	// bucket table: hash(entityID, eventClass, ringDigest) -> saturating counter
+	buckets map[uint64]uint8
+
+	// per-entity ring of the last ringSize action classes dispatched
+	rings map[string][]string
+
+	storage historystorage.HistoryStorage
+
+	hitCount         uint64
+	newBucketsThisRun uint64
+}
+
+func New() *Coverage {
+	nextActionChan := make(chan signal.Action)
+	q := queue.NewBasicTBQueue()
+	c := &Coverage{
+		nextActionChan:            nextActionChan,
+		queue:                     q,
+		queueDeqCh:                q.GetDequeueChan(),
+		shelActionRoutineRunning:  false,
+		MinInterval:               time.Duration(0),
+		MaxInterval:               time.Duration(0),
+		PrioritizedEntities:       make(map[string]bool, 0),
+		ShellActionInterval:       time.Duration(0),
+		ShellActionCommand:        "",
+		FaultActionProbability:    0.0,
+		rng:                       rand.New(rand.NewSource(time.Now().UnixNano())),
+		buckets:                   make(map[uint64]uint8),
+		rings:                     make(map[string][]string),
+	}
+	go c.dequeueEventRoutine()
+	return c
+}
+
+const Name = "coverage"
+
+// returns "coverage"
+func (this *Coverage) Name() string {
+	return Name
+}
+
+// parameters: minInterval, maxInterval, prioritizedEntities,
+// shellActionInterval, shellActionCommand and faultActionProbability, with
+// the same meaning as for the "random" policy (its other parameters, such
+// as procResetSchedProbability and randomSeed, are not read), except that
+// faultActionProbability is used only as a tie-break: when both branches of
+// a decision hash to an equally-rare bucket (as happens the first time a
+// context is seen), the fault branch is taken with that probability
+// instead of always deferring to default.
+//
+// should support dynamic reloading
+func (c *Coverage) LoadConfig(cfg config.Config) error {
+	policyName := cfg.GetString("explorePolicy")
+	if policyName != c.Name() {
+		log.Warnf("Policy name mismatch: \"%s\" != \"%s\"", policyName, c.Name())
+	}
+
+	epp := "explorepolicyparam."
+	paramMinInterval := epp + "minInterval"
+	if cfg.IsSet(paramMinInterval) {
+		c.MinInterval = cfg.GetDuration(paramMinInterval)
+		log.Infof("Set minInterval=%s", c.MinInterval)
+	} else {
+		log.Infof("Using default minInterval=%s", c.MinInterval)
+	}
+
+	paramMaxInterval := epp + "maxInterval"
+	if cfg.IsSet(paramMaxInterval) {
+		c.MaxInterval = cfg.GetDuration(paramMaxInterval)
+		log.Infof("Set maxInterval=%s", c.MaxInterval)
+	} else {
+		c.MaxInterval = c.MinInterval
+		log.Infof("Using default maxInterval=%s", c.MaxInterval)
+	}
+
+	paramPrioritizedEntities := epp + "prioritizedEntities"
+	if cfg.IsSet(paramPrioritizedEntities) {
+		slice := cfg.GetStringSlice(paramPrioritizedEntities)
+		if slice != nil {
+			for i := 0; i < len(slice); i++ {
+				c.PrioritizedEntities[slice[i]] = true
+			}
+			log.Debugf("Set prioritizedEntities=%s", c.PrioritizedEntities)
+		}
+	}
+
+	paramShellActionInterval := epp + "shellActionInterval"
+	if cfg.IsSet(paramShellActionInterval) {
+		c.ShellActionInterval = cfg.GetDuration(paramShellActionInterval)
+		log.Infof("Set shellActionInterval=%s", c.ShellActionInterval)
+	}
+
+	paramShellActionCommand := epp + "shellActionCommand"
+	if cfg.IsSet(paramShellActionCommand) {
+		c.ShellActionCommand = cfg.GetString(paramShellActionCommand)
+		log.Infof("Set shellActionCommand=%s", c.ShellActionCommand)
+	}
+
+	if c.ShellActionInterval < 0 {
+		return fmt.Errorf("shellActionInterval(=%s) must be non-negative value", c.ShellActionInterval)
+	}
+
+	if c.ShellActionInterval == 0 && c.ShellActionCommand != "" {
+		log.Warn("shellActionCommand will be ignored, because shellActionInterval is zero.")
+	}
+
+	if c.ShellActionInterval > 0 && !c.shelActionRoutineRunning {
+		// FIXME: not thread safe!
+		c.shelActionRoutineRunning = true
+		go c.shellFaultInjectionRoutine()
+	}
+
+	paramFaultActionProbability := epp + "faultActionProbability"
+	if cfg.IsSet(paramFaultActionProbability) {
+		c.FaultActionProbability = cfg.GetFloat64(paramFaultActionProbability)
+		log.Infof("Set faultActionProbability=%f", c.FaultActionProbability)
+	}
+	if c.FaultActionProbability < 0.0 || c.FaultActionProbability > 1.0 {
+		return fmt.Errorf("bad faultActionProbability %f", c.FaultActionProbability)
+	}
+
+	return nil
+}
+
+// SetHistoryStorage loads a previously persisted bucket table from the
+// storage's base directory, if any, so coverage accumulates across
+// fuzzing sessions.
+func (c *Coverage) SetHistoryStorage(storage historystorage.HistoryStorage) error {
+	c.storage = storage
+
+	path := c.bucketsFilePath()
+	if path == "" {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := json.NewDecoder(f).Decode(&c.buckets); err != nil {
+		return fmt.Errorf("failed to load %s: %s", path, err)
+	}
+	log.Infof("Loaded %d previously observed coverage buckets from %s", len(c.buckets), path)
+	return nil
+}
+
+func (c *Coverage) bucketsFilePath() string {
+	if c.storage == nil {
+		return ""
+	}
+	return filepath.Join(c.storage.BaseDir(), bucketsFileName)
+}
+
+// persistBuckets writes the bucket table back to the historystorage
+// base directory so that the next run picks up where this one left off.
+func (c *Coverage) persistBuckets() {
+	path := c.bucketsFilePath()
+	if path == "" {
+		return
+	}
+
+	c.mutex.Lock()
+	buf, err := json.Marshal(c.buckets)
+	c.mutex.Unlock()
+	if err != nil {
+		log.Warnf("Failed to marshal coverage buckets: %s", err)
+		return
+	}
+
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		log.Warnf("Failed to persist coverage buckets to %s: %s", path, err)
+	}
+}
+
+func (c *Coverage) ActionChan() chan signal.Action {
+	return c.nextActionChan
+}
+
+// put a ShellAction to nextActionChan
+func (c *Coverage) shellFaultInjectionRoutine() {
+	if c.ShellActionInterval == 0 {
+		panic(fmt.Errorf("implementation error. should not be called here."))
+	}
+	for {
+		<-time.After(c.ShellActionInterval)
+		comments := map[string]interface{}{
+			"comment": "injected by the coverage explorer",
+		}
+		action, err := signal.NewShellAction(c.ShellActionCommand, comments)
+		if err != nil {
+			panic(log.Critical(err))
+		}
+		c.nextActionChan <- action
+	}
+}
+
+// bucketDigest hashes (entityID, eventClass, ringDigest) into a bucket key.
+func bucketDigest(entityID, eventClass, ringDigest string) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%s\x00%s", entityID, eventClass, ringDigest)
+	return h.Sum64()
+}
+
+func ringDigestFor(ring []string) string {
+	digest := ""
+	for _, a := range ring {
+		digest += a + ","
+	}
+	return digest
+}
+
+// bucketCount returns the current saturating counter for bucket, without
+// mutating it.
+func (c *Coverage) bucketCount(bucket uint64) uint8 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.buckets[bucket]
+}
+
+// touchBucket increments the saturating counter for bucket and reports
+// whether this was the first time it was observed.
+func (c *Coverage) touchBucket(bucket uint64) (isNew bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	count, ok := c.buckets[bucket]
+	if !ok {
+		c.newBucketsThisRun++
+	}
+	if count < counterMax {
+		count++
+	}
+	c.buckets[bucket] = count
+	c.hitCount++
+	return !ok
+}
+
+func (c *Coverage) pushRing(entityID, actionClass string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ring := c.rings[entityID]
+	ring = append(ring, actionClass)
+	if len(ring) > ringSize {
+		ring = ring[len(ring)-ringSize:]
+	}
+	c.rings[entityID] = ring
+}
+
+func (c *Coverage) ringFor(entityID string) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string(nil), c.rings[entityID]...)
+}
+
+// for dequeueRoutine()
+func (c *Coverage) makeActionForEvent(event signal.Event) (signal.Action, error, bool) {
+	switch event.(type) {
+	case *signal.ProcSetEvent:
+		action, err := event.(*signal.ProcSetEvent).DefaultAction()
+		return action, err, false
+	}
+	defaultAction, defaultActionErr := event.DefaultAction()
+	faultAction, faultActionErr := event.DefaultFaultAction()
+	if faultAction == nil {
+		isNew := c.recordDecision(event, false)
+		return defaultAction, defaultActionErr, isNew
+	}
+
+	ringDigest := ringDigestFor(c.ringFor(event.EntityID()))
+	defaultBucket := bucketDigest(event.EntityID(), event.EventClass()+":default", ringDigest)
+	faultBucket := bucketDigest(event.EntityID(), event.EventClass()+":fault", ringDigest)
+
+	faultCount := c.bucketCount(faultBucket)
+	defaultCount := c.bucketCount(defaultBucket)
+	var isFault bool
+	switch {
+	case faultCount < defaultCount:
+		isFault = true
+	case faultCount > defaultCount:
+		isFault = false
+	default:
+		// equally-rare (or both unseen): break the tie with
+		// faultActionProbability instead of always picking default.
+		isFault = c.rng.Float64() < c.FaultActionProbability
+	}
+	var action signal.Action
+	var err error
+	if isFault {
+		log.Debugf("Coverage: biasing toward fault branch for %s (bucket=%x)", event, faultBucket)
+		action, err = faultAction, faultActionErr
+	} else {
+		action, err = defaultAction, defaultActionErr
+	}
+	isNew := c.recordDecision(event, isFault)
+	return action, err, isNew
+}
+
+// recordDecision updates the ring and bucket table after a decision has
+// been made for event, keyed on whether the dispatched action was the
+// fault branch or the default branch, and reports whether the bucket was
+// first observed during this call.
+func (c *Coverage) recordDecision(event signal.Event, isFault bool) bool {
+	actionClass := "default"
+	if isFault {
+		actionClass = "fault"
+	}
+	ringDigest := ringDigestFor(c.ringFor(event.EntityID()))
+	bucket := bucketDigest(event.EntityID(), event.EventClass()+":"+actionClass, ringDigest)
+	isNew := c.touchBucket(bucket)
+	c.pushRing(event.EntityID(), actionClass)
+	return isNew
+}
+
+// dequeue event, determine corresponding action, and put the action to nextActionChan
+func (c *Coverage) dequeueEventRoutine() {
+	for {
+		qItem := <-c.queueDeqCh
+		event := qItem.Value().(signal.Event)
+		action, err, isNew := c.makeActionForEvent(event)
+		log.Debugf("COVERAGE: Determined action %#v for event %#v", action, event)
+		if err != nil {
+			panic(log.Critical(err))
+		}
+		if isNew {
+			c.persistBuckets()
+		}
+		c.nextActionChan <- action
+	}
+}
+
+// QueueEvent weights the min/max delay sampled for event by bucket
+// rarity: states never seen before (a combined count of 0) get the same
+// "prioritized" shortening as explorepolicyparam.prioritizedEntities,
+// states seen more than counterMax/2 times are delayed instead, and all
+// other states keep the configured intervals.
+func (c *Coverage) QueueEvent(event signal.Event) {
+	minInterval := c.MinInterval
+	maxInterval := c.MaxInterval
+
+	// count combines the ":default" and ":fault" buckets actually
+	// incremented by recordDecision, since the outcome of this event
+	// isn't known yet at enqueue time.
+	ringDigest := ringDigestFor(c.ringFor(event.EntityID()))
+	defaultBucket := bucketDigest(event.EntityID(), event.EventClass()+":default", ringDigest)
+	faultBucket := bucketDigest(event.EntityID(), event.EventClass()+":fault", ringDigest)
+	count := int(c.bucketCount(defaultBucket)) + int(c.bucketCount(faultBucket))
+
+	_, prioritized := c.PrioritizedEntities[event.EntityID()]
+	switch {
+	case prioritized || count == 0:
+		// rare (or explicitly prioritized) bucket: shorten the delay
+		minInterval = time.Duration(float64(minInterval) * 0.8)
+		maxInterval = time.Duration(float64(maxInterval) * 0.8)
+	case count > counterMax/2:
+		// frequently seen bucket: delay it in favor of rarer states
+		minInterval = time.Duration(float64(minInterval) * 1.2)
+		maxInterval = time.Duration(float64(maxInterval) * 1.2)
+	}
+
+	item, err := queue.NewBasicTBQueueItem(event, minInterval, maxInterval)
+	if err != nil {
+		panic(log.Critical(err))
+	}
+	c.queue.Enqueue(item)
+}
+
+// Stats returns coverage bookkeeping for reporting: the total number of
+// bucket hits recorded so far, the number of distinct buckets observed
+// (including ones loaded from a previous run), and the number of buckets
+// first observed during this run.
+func (c *Coverage) Stats() (hitCount, uniqueBuckets, newBucketsThisRun uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.hitCount, uint64(len(c.buckets)), c.newBucketsThisRun
+}
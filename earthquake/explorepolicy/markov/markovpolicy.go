@@ -0,0 +1,343 @@
+// Copyright (C) 2015 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package markov provides a policy that learns an n-gram model over the
+// (eventClass, faultInjected) pairs of previously recorded traces, and
+// uses it to bias new fault-vs-default decisions
+// toward schedules similar to ones seen before -- optionally weighted
+// toward schedules that previously exposed a bug. The recorded action
+// class enters the model only as whether it is a fault action; the class
+// name itself is not part of a token.
+package markov
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/cihub/seelog"
+	"github.com/osrg/earthquake/earthquake/historystorage"
+	"github.com/osrg/earthquake/earthquake/signal"
+	"github.com/osrg/earthquake/earthquake/util/config"
+	queue "github.com/osrg/earthquake/earthquake/util/queue"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const Name = "markov"
+
+// contextSize is N in the n-gram model: the number of past tokens used
+// to predict the next one.
+const contextSize = 3
+
+// token identifies one historical decision: which event class it was
+// made for, and whether a fault was injected.
+type token struct {
+	EventClass string
+	Fault      bool
+}
+
+func (t token) String() string {
+	return fmt.Sprintf("%s:%t", t.EventClass, t.Fault)
+}
+
+// successorCounts holds the learned counts of what followed a given
+// context, split into fault/non-fault buckets.
+type successorCounts struct {
+	Fault   float64
+	Default float64
+}
+
+type Markov struct {
+	// channel
+	nextActionChan chan signal.Action
+
+	// queue
+	queue      queue.TimeBoundedQueue
+	queueDeqCh chan queue.TimeBoundedQueueItem
+
+	// parameter "faultActionProbability", used when a context has
+	// never been observed
+	FaultActionProbability float64
+
+	// parameter "preferFailedTraces"
+	PreferFailedTraces bool
+
+	// parameter "alpha": Laplace smoothing parameter
+	Alpha float64
+
+	// parameter "modelExportPath"
+	ModelExportPath string
+
+	mutex sync.Mutex
+	rng   *rand.Rand
+
+	// model[context] -> successorCounts, where context is the
+	// "|"-joined String() of the last contextSize tokens
+	model map[string]*successorCounts
+
+	// per-entity ring of the last contextSize tokens dispatched
+	rings map[string][]token
+}
+
+func New() *Markov {
+	nextActionChan := make(chan signal.Action)
+	q := queue.NewBasicTBQueue()
+	m := &Markov{
+		nextActionChan:         nextActionChan,
+		queue:                  q,
+		queueDeqCh:             q.GetDequeueChan(),
+		FaultActionProbability: 0.0,
+		PreferFailedTraces:     false,
+		Alpha:                  1.0,
+		rng:                    rand.New(rand.NewSource(time.Now().UnixNano())),
+		model:                  make(map[string]*successorCounts),
+		rings:                  make(map[string][]token),
+	}
+	go m.dequeueEventRoutine()
+	return m
+}
+
+// returns "markov"
+func (this *Markov) Name() string {
+	return Name
+}
+
+// parameters:
+//  - faultActionProbability(float64): fallback probability of injecting
+//    a fault when the current context was never observed (default: 0.0)
+//
+//  - preferFailedTraces(bool): weight counts learned from traces where
+//    IsSucceed()==false more heavily, so the model drifts toward
+//    schedules that previously exposed a bug (default: false)
+//
+//  - alpha(float64): Laplace smoothing parameter added to every
+//    fault/default count (default: 1.0)
+//
+//  - modelExportPath(string): if set, dump the learned transition table
+//    as JSON to this path after SetHistoryStorage builds it (default: "")
+func (m *Markov) LoadConfig(cfg config.Config) error {
+	policyName := cfg.GetString("explorePolicy")
+	if policyName != m.Name() {
+		log.Warnf("Policy name mismatch: \"%s\" != \"%s\"", policyName, m.Name())
+	}
+
+	epp := "explorepolicyparam."
+	if cfg.IsSet(epp + "faultActionProbability") {
+		m.FaultActionProbability = cfg.GetFloat64(epp + "faultActionProbability")
+	}
+	if m.FaultActionProbability < 0.0 || m.FaultActionProbability > 1.0 {
+		return fmt.Errorf("bad faultActionProbability %f", m.FaultActionProbability)
+	}
+
+	if cfg.IsSet(epp + "preferFailedTraces") {
+		m.PreferFailedTraces = cfg.GetBool(epp + "preferFailedTraces")
+	}
+
+	if cfg.IsSet(epp + "alpha") {
+		m.Alpha = cfg.GetFloat64(epp + "alpha")
+	}
+	if m.Alpha < 0.0 {
+		return fmt.Errorf("bad alpha %f", m.Alpha)
+	}
+
+	if cfg.IsSet(epp + "modelExportPath") {
+		m.ModelExportPath = cfg.GetString(epp + "modelExportPath")
+	}
+
+	return nil
+}
+
+// SetHistoryStorage builds the n-gram model from every trace already
+// recorded in storage.
+func (m *Markov) SetHistoryStorage(storage historystorage.HistoryStorage) error {
+	nr := storage.NrStoredHistories()
+	for i := 0; i < nr; i++ {
+		trace, err := storage.GetStoredHistory(i)
+		if err != nil {
+			log.Warnf("markov: failed to load trace %d: %s", i, err)
+			continue
+		}
+
+		weight := 1.0
+		if m.PreferFailedTraces {
+			if succeed, err := storage.IsSucceed(i); err == nil && !succeed {
+				// FIXME: magic coefficient for weighting failed traces
+				weight = 4.0
+			}
+		}
+
+		m.learnTrace(trace, weight)
+	}
+
+	log.Infof("markov: learned %d contexts from %d stored traces", len(m.model), nr)
+
+	if m.ModelExportPath != "" {
+		if err := m.exportModel(); err != nil {
+			log.Warnf("markov: failed to export model to %s: %s", m.ModelExportPath, err)
+		}
+	}
+	return nil
+}
+
+// learnTrace replays one stored trace, keeping a separate context ring
+// per entity so that the contexts it trains on match the per-entity
+// rings makeActionForEvent looks up at inference time.
+func (m *Markov) learnTrace(trace *historystorage.SingleTrace, weight float64) {
+	rings := make(map[string][]token)
+	for _, act := range trace.ActionSequence {
+		entityID := fmt.Sprintf("%v", act.Evt.EventParam["entity_id"])
+		eventClass := fmt.Sprintf("%v", act.Evt.EventParam["class"])
+		// recorded ActionParam carries "class"/"uuid", not a "fault" flag;
+		// a fault was injected iff the recorded action class is the
+		// "...FaultAction" type returned by DefaultFaultAction().
+		actionClass := fmt.Sprintf("%v", act.ActionParam["class"])
+		faultInjected := strings.HasSuffix(actionClass, "FaultAction")
+		tok := token{EventClass: eventClass, Fault: faultInjected}
+
+		ring := rings[entityID]
+		if len(ring) > 0 {
+			m.addObservation(contextKey(ring), tok, weight)
+		}
+
+		ring = append(ring, tok)
+		if len(ring) > contextSize {
+			ring = ring[len(ring)-contextSize:]
+		}
+		rings[entityID] = ring
+	}
+}
+
+func (m *Markov) addObservation(context string, next token, weight float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	counts, ok := m.model[context]
+	if !ok {
+		counts = &successorCounts{}
+		m.model[context] = counts
+	}
+	if next.Fault {
+		counts.Fault += weight
+	} else {
+		counts.Default += weight
+	}
+}
+
+func contextKey(ring []token) string {
+	parts := make([]string, len(ring))
+	for i, t := range ring {
+		parts[i] = t.String()
+	}
+	return strings.Join(parts, "|")
+}
+
+func (m *Markov) exportModel() error {
+	m.mutex.Lock()
+	buf, err := json.MarshalIndent(m.model, "", "  ")
+	m.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(m.ModelExportPath, buf, 0644)
+}
+
+func (m *Markov) ActionChan() chan signal.Action {
+	return m.nextActionChan
+}
+
+func (m *Markov) ringFor(entityID string) []token {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]token(nil), m.rings[entityID]...)
+}
+
+func (m *Markov) pushRing(entityID string, tok token) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	ring := append(m.rings[entityID], tok)
+	if len(ring) > contextSize {
+		ring = ring[len(ring)-contextSize:]
+	}
+	m.rings[entityID] = ring
+}
+
+// faultProbability looks up the successor distribution for context and
+// returns P(fault), applying Laplace smoothing with m.Alpha. It falls
+// back to FaultActionProbability when the context has never been seen.
+func (m *Markov) faultProbability(context string) float64 {
+	m.mutex.Lock()
+	counts, ok := m.model[context]
+	m.mutex.Unlock()
+	if !ok {
+		return m.FaultActionProbability
+	}
+	return (counts.Fault + m.Alpha) / (counts.Fault + counts.Default + 2*m.Alpha)
+}
+
+// for dequeueRoutine()
+func (m *Markov) makeActionForEvent(event signal.Event) (signal.Action, error) {
+	switch event.(type) {
+	case *signal.ProcSetEvent:
+		return event.(*signal.ProcSetEvent).DefaultAction()
+	}
+	defaultAction, defaultActionErr := event.DefaultAction()
+	faultAction, faultActionErr := event.DefaultFaultAction()
+	if faultAction == nil {
+		m.recordDecision(event, false)
+		return defaultAction, defaultActionErr
+	}
+
+	context := contextKey(m.ringFor(event.EntityID()))
+	p := m.faultProbability(context)
+
+	var injectFault bool
+	if m.rng.Float64() < p {
+		injectFault = true
+	}
+	m.recordDecision(event, injectFault)
+
+	if injectFault {
+		log.Debugf("Markov: injecting fault %s for %s (context=%q, p=%f)", faultAction, event, context, p)
+		return faultAction, faultActionErr
+	}
+	return defaultAction, defaultActionErr
+}
+
+func (m *Markov) recordDecision(event signal.Event, faultInjected bool) {
+	m.pushRing(event.EntityID(), token{EventClass: event.EventClass(), Fault: faultInjected})
+}
+
+// dequeue event, determine corresponding action, and put the action to nextActionChan
+func (m *Markov) dequeueEventRoutine() {
+	for {
+		qItem := <-m.queueDeqCh
+		event := qItem.Value().(signal.Event)
+		action, err := m.makeActionForEvent(event)
+		log.Debugf("MARKOV: Determined action %#v for event %#v", action, event)
+		if err != nil {
+			panic(log.Critical(err))
+		}
+		m.nextActionChan <- action
+	}
+}
+
+func (m *Markov) QueueEvent(event signal.Event) {
+	item, err := queue.NewBasicTBQueueItem(event, 0, 0)
+	if err != nil {
+		panic(log.Critical(err))
+	}
+	m.queue.Enqueue(item)
+}
@@ -22,8 +22,10 @@ import (
 	"github.com/osrg/earthquake/earthquake/historystorage"
 	"github.com/osrg/earthquake/earthquake/signal"
 	"github.com/osrg/earthquake/earthquake/util/config"
+	"github.com/osrg/earthquake/earthquake/util/metrics"
 	queue "github.com/osrg/earthquake/earthquake/util/queue"
 	"math/rand"
+	"sync"
 	"time"
 )
 
@@ -58,11 +60,52 @@ type Random struct {
 
 	// parameter "procResetSchedProbability”
 	ProcResetSchedProbability float64
+
+	// parameter "randomSeed"
+	RandomSeed int64
+
+	// rng is seeded from RandomSeed so that, given the same seed and
+	// the same historystorage, two runs pick the same actions.
+	rng *rand.Rand
+
+	// parameter "replayMode": when true, makeActionForEvent replays a
+	// previously recorded trace instead of picking actions at random.
+	ReplayMode bool
+
+	// parameter "replayTraceID": index of the stored trace to replay
+	ReplayTraceID int
+
+	// parameter "replayDivergencePolicy"
+	ReplayDivergencePolicy string
+
+	replaySteps  []replayStep
+	replayCursor int
+
+	// enqueueTimes tracks when each queued item was enqueued, keyed by
+	// the item itself, so dequeueEventRoutine can report queue wait time.
+	enqueueTimesMu sync.Mutex
+	enqueueTimes   map[queue.TimeBoundedQueueItem]time.Time
 }
 
+// replayStep is one entry of a recorded trace, reduced to what is needed
+// to match it against a live signal.Event.
+type replayStep struct {
+	entityID    string
+	eventClass  string
+	eventOption string
+	actionClass string
+}
+
+const (
+	ReplayDivergenceStrict         = "strict"
+	ReplayDivergenceSkip           = "skip"
+	ReplayDivergenceFallbackRandom = "fallback-random"
+)
+
 func New() *Random {
 	nextActionChan := make(chan signal.Action)
 	q := queue.NewBasicTBQueue()
+	seed := time.Now().UnixNano()
 	r := &Random{
 		nextActionChan:            nextActionChan,
 		queue:                     q,
@@ -75,6 +118,11 @@ func New() *Random {
 		ShellActionCommand:        "",
 		FaultActionProbability:    0.0,
 		ProcResetSchedProbability: 0.1,
+		RandomSeed:                seed,
+		rng:                       rand.New(rand.NewSource(seed)),
+		ReplayMode:                false,
+		ReplayDivergencePolicy:    ReplayDivergenceStrict,
+		enqueueTimes:              make(map[queue.TimeBoundedQueueItem]time.Time),
 	}
 	go r.dequeueEventRoutine()
 	return r
@@ -104,6 +152,19 @@ func (this *Random) Name() string {
 //
 //  - procResetSchedProbability(float64): probability (0.0-1.0) for resetting ProcSetSchedAction (default: 0.1)
 //
+//  - randomSeed(int64): seed for the PRNG driving fault injection decisions
+//    (default: current time in nanoseconds, i.e. non-reproducible)
+//
+//  - replayMode(bool): if true, replay the trace named by replayTraceID
+//    instead of picking actions at random (default: false)
+//
+//  - replayTraceID(int): index of the stored trace to replay, as
+//    passed to historystorage.HistoryStorage.GetStoredHistory (default: 0)
+//
+//  - replayDivergencePolicy(string): one of "strict", "skip",
+//    "fallback-random"; what to do when a live event does not match the
+//    next expected step of the replayed trace (default: "strict")
+//
 // should support dynamic reloading
 func (r *Random) LoadConfig(cfg config.Config) error {
 	policyName := cfg.GetString("explorePolicy")
@@ -184,10 +245,62 @@ func (r *Random) LoadConfig(cfg config.Config) error {
 	if r.ProcResetSchedProbability < 0.0 || r.ProcResetSchedProbability > 1.0 {
 		return fmt.Errorf("bad procResetSchedProbability %f", r.ProcResetSchedProbability)
 	}
+
+	paramRandomSeed := epp + "randomSeed"
+	if cfg.IsSet(paramRandomSeed) {
+		r.RandomSeed = cfg.GetInt64(paramRandomSeed)
+		r.rng = rand.New(rand.NewSource(r.RandomSeed))
+		log.Infof("Set randomSeed=%d", r.RandomSeed)
+	}
+
+	paramReplayMode := epp + "replayMode"
+	if cfg.IsSet(paramReplayMode) {
+		r.ReplayMode = cfg.GetBool(paramReplayMode)
+		log.Infof("Set replayMode=%t", r.ReplayMode)
+	}
+
+	paramReplayTraceID := epp + "replayTraceID"
+	if cfg.IsSet(paramReplayTraceID) {
+		r.ReplayTraceID = cfg.GetInt(paramReplayTraceID)
+		log.Infof("Set replayTraceID=%d", r.ReplayTraceID)
+	}
+
+	paramReplayDivergencePolicy := epp + "replayDivergencePolicy"
+	if cfg.IsSet(paramReplayDivergencePolicy) {
+		r.ReplayDivergencePolicy = cfg.GetString(paramReplayDivergencePolicy)
+	}
+	switch r.ReplayDivergencePolicy {
+	case ReplayDivergenceStrict, ReplayDivergenceSkip, ReplayDivergenceFallbackRandom:
+	default:
+		return fmt.Errorf("bad replayDivergencePolicy %q", r.ReplayDivergencePolicy)
+	}
+
 	return nil
 }
 
+// SetHistoryStorage loads the trace named by ReplayTraceID when
+// ReplayMode is enabled, so that makeActionForEvent can replay it.
 func (r *Random) SetHistoryStorage(storage historystorage.HistoryStorage) error {
+	if !r.ReplayMode {
+		return nil
+	}
+
+	trace, err := storage.GetStoredHistory(r.ReplayTraceID)
+	if err != nil {
+		return fmt.Errorf("replay: failed to load trace %d: %s", r.ReplayTraceID, err)
+	}
+
+	r.replaySteps = make([]replayStep, 0, len(trace.ActionSequence))
+	for _, act := range trace.ActionSequence {
+		r.replaySteps = append(r.replaySteps, replayStep{
+			entityID:    fmt.Sprintf("%v", act.Evt.EventParam["entity_id"]),
+			eventClass:  fmt.Sprintf("%v", act.Evt.EventParam["class"]),
+			eventOption: fmt.Sprintf("%v", act.Evt.EventParam["option"]),
+			actionClass: fmt.Sprintf("%v", act.ActionParam["class"]),
+		})
+	}
+	r.replayCursor = 0
+	log.Infof("Loaded %d steps from trace %d for replay", len(r.replaySteps), r.ReplayTraceID)
 	return nil
 }
 
@@ -202,20 +315,30 @@ func (r *Random) shellFaultInjectionRoutine() {
 	}
 	for {
 		<-time.After(r.ShellActionInterval)
+
+		span := metrics.StartDecisionSpan(Name, "shellFaultInjection")
 		// NOTE: you can also set arbitrary info (e.g., expected shutdown or unexpected kill)
 		comments := map[string]interface{}{
 			"comment": "injected by the random explorer",
 		}
+		for k, v := range metrics.SpanComments(span) {
+			comments[k] = v
+		}
 		action, err := signal.NewShellAction(r.ShellActionCommand, comments)
+		span.Finish()
 		if err != nil {
 			panic(log.Critical(err))
 		}
+		metrics.ShellFaultInjections.WithLabelValues(Name).Inc()
 		r.nextActionChan <- action
 	}
 }
 
 // for dequeueRoutine()
 func (r *Random) makeActionForEvent(event signal.Event) (signal.Action, error) {
+	if r.ReplayMode {
+		return r.makeActionForEventReplay(event)
+	}
 	switch event.(type) {
 	case *signal.ProcSetEvent:
 		return r.makeActionForProcSetEvent(event.(*signal.ProcSetEvent))
@@ -223,22 +346,106 @@ func (r *Random) makeActionForEvent(event signal.Event) (signal.Action, error) {
 	defaultAction, defaultActionErr := event.DefaultAction()
 	faultAction, faultActionErr := event.DefaultFaultAction()
 	if faultAction == nil {
+		r.recordDispatched(defaultAction, false)
 		return defaultAction, defaultActionErr
 	}
-	if rand.Intn(999) < int(r.FaultActionProbability*1000.0) {
+	if r.rng.Intn(999) < int(r.FaultActionProbability*1000.0) {
 		log.Debugf("Injecting fault %s for %s", faultAction, event)
+		r.recordDispatched(faultAction, true)
 		return faultAction, faultActionErr
 	} else {
+		r.recordDispatched(defaultAction, false)
 		return defaultAction, defaultActionErr
 	}
 }
 
+// recordDispatched updates the actions_dispatched_total counter for the
+// action this policy just decided to emit.
+func (r *Random) recordDispatched(action signal.Action, faultInjected bool) {
+	actionClass := ""
+	if action != nil {
+		actionClass = action.Class()
+	}
+	metrics.ActionsDispatched.WithLabelValues(Name, actionClass, fmt.Sprintf("%t", faultInjected)).Inc()
+}
+
+// MakeActionForEvent exposes makeActionForEvent so that other policies
+// (e.g. "replay" in fallback-random mode) can delegate to the same
+// random decision logic instead of duplicating it.
+func (r *Random) MakeActionForEvent(event signal.Event) (signal.Action, error) {
+	return r.makeActionForEvent(event)
+}
+
+// makeActionForEventReplay matches event against the next expected step
+// of the loaded trace by (entityID, eventClass, eventOption), and
+// re-emits the action that was recorded for it.
+func (r *Random) makeActionForEventReplay(event signal.Event) (signal.Action, error) {
+	if r.replayCursor >= len(r.replaySteps) {
+		return r.handleReplayDivergence(event, fmt.Errorf("replay: trace %d is exhausted", r.ReplayTraceID))
+	}
+
+	expected := r.replaySteps[r.replayCursor]
+	eventClass, eventOption := eventDigest(event)
+	if expected.entityID != event.EntityID() || expected.eventClass != eventClass || expected.eventOption != eventOption {
+		return r.handleReplayDivergence(event, fmt.Errorf(
+			"replay: event %s (entity=%s class=%s option=%v) does not match expected step %d (entity=%s class=%s option=%v)",
+			event, event.EntityID(), eventClass, eventOption,
+			r.replayCursor, expected.entityID, expected.eventClass, expected.eventOption))
+	}
+
+	r.replayCursor++
+	defaultAction, defaultActionErr := event.DefaultAction()
+	faultAction, faultActionErr := event.DefaultFaultAction()
+	if faultAction != nil && faultAction.Class() == expected.actionClass {
+		return faultAction, faultActionErr
+	}
+	return defaultAction, defaultActionErr
+}
+
+func (r *Random) handleReplayDivergence(event signal.Event, cause error) (signal.Action, error) {
+	switch r.ReplayDivergencePolicy {
+	case ReplayDivergenceSkip:
+		log.Warnf("%s (skipping)", cause)
+		return event.DefaultAction()
+	case ReplayDivergenceFallbackRandom:
+		log.Warnf("%s (falling back to random)", cause)
+		r.ReplayMode = false
+		action, err := r.makeActionForEvent(event)
+		r.ReplayMode = true
+		return action, err
+	default:
+		panic(log.Critical(cause))
+	}
+}
+
+// eventDigest extracts the (eventClass, eventOption) part of the digest
+// that a recorded trace step is matched against. eventOption is
+// stringified so that options decoding to a non-comparable type (a map
+// or slice from JSON) can still be compared with "!=" against a
+// replayStep without panicking.
+func eventDigest(event signal.Event) (eventClass string, eventOption string) {
+	return event.EventClass(), fmt.Sprintf("%v", event.EventOption())
+}
+
 // dequeue event, determine corresponding action, and put the action to nextActionChan
 func (r *Random) dequeueEventRoutine() {
 	for {
 		qItem := <-r.queueDeqCh
 		event := qItem.Value().(signal.Event)
+		metrics.EventsDequeued.WithLabelValues(Name).Inc()
+
+		r.enqueueTimesMu.Lock()
+		enqueuedAt, ok := r.enqueueTimes[qItem]
+		delete(r.enqueueTimes, qItem)
+		r.enqueueTimesMu.Unlock()
+		if ok {
+			metrics.ObserveQueueWait(Name, time.Since(enqueuedAt))
+		}
+
+		span := metrics.StartDecisionSpan(Name, event.EventClass())
 		action, err := r.makeActionForEvent(event)
+		span.Finish()
+
 		log.Debugf("RANDOM: Determined action %#v for event %#v", action, event)
 		if err != nil {
 			panic(log.Critical(err))
@@ -248,10 +455,17 @@ func (r *Random) dequeueEventRoutine() {
 }
 
 func (r *Random) QueueEvent(event signal.Event) {
+	metrics.EventsQueued.WithLabelValues(Name).Inc()
+
 	minInterval := r.MinInterval
 	maxInterval := r.MaxInterval
-	_, prioritized := r.PrioritizedEntities[event.EntityID()]
-	if prioritized {
+	if r.ReplayMode {
+		// replay reproduces the recorded schedule by matching events
+		// against replayCursor in order; any jitter here can reorder a
+		// live event past its expected step and make replay diverge.
+		minInterval = 0
+		maxInterval = 0
+	} else if _, prioritized := r.PrioritizedEntities[event.EntityID()]; prioritized {
 		// FIXME: magic coefficient for prioritizing (decrease intervals)
 		minInterval = time.Duration(float64(minInterval) * 0.8)
 		maxInterval = time.Duration(float64(maxInterval) * 0.8)
@@ -260,5 +474,8 @@ func (r *Random) QueueEvent(event signal.Event) {
 	if err != nil {
 		panic(log.Critical(err))
 	}
+	r.enqueueTimesMu.Lock()
+	r.enqueueTimes[item] = time.Now()
+	r.enqueueTimesMu.Unlock()
 	r.queue.Enqueue(item)
 }
@@ -0,0 +1,234 @@
+// Copyright (C) 2015 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package replay provides a policy that deterministically replays a
+// trace previously recorded by historystorage, instead of picking
+// actions non-deterministically like "random" does.
+package replay
+
+import (
+	"fmt"
+	log "github.com/cihub/seelog"
+	"github.com/osrg/earthquake/earthquake/explorepolicy/random"
+	"github.com/osrg/earthquake/earthquake/historystorage"
+	"github.com/osrg/earthquake/earthquake/signal"
+	"github.com/osrg/earthquake/earthquake/util/config"
+	queue "github.com/osrg/earthquake/earthquake/util/queue"
+)
+
+const Name = "replay"
+
+// DivergencePolicy controls what happens when a live event does not
+// match the next expected step of the replayed trace.
+type DivergencePolicy string
+
+const (
+	// DivergenceStrict panics as soon as the live schedule diverges.
+	DivergenceStrict DivergencePolicy = "strict"
+	// DivergenceSkip drops the unmatched event and keeps waiting for
+	// the next expected one.
+	DivergenceSkip DivergencePolicy = "skip"
+	// DivergenceFallbackRandom hands the event to an embedded Random
+	// policy and records that the trace diverged at this point.
+	DivergenceFallbackRandom DivergencePolicy = "fallback-random"
+)
+
+// step is one entry of a recorded trace, reduced to what is needed to
+// match it against a live signal.Event.
+type step struct {
+	entityID    string
+	eventClass  string
+	eventOption string
+	actionClass string
+}
+
+type Replay struct {
+	// channel
+	nextActionChan chan signal.Action
+
+	// queue
+	queue      queue.TimeBoundedQueue
+	queueDeqCh chan queue.TimeBoundedQueueItem
+
+	// parameter "traceID"
+	TraceID int
+
+	// parameter "divergencePolicy"
+	Divergence DivergencePolicy
+
+	// fallback is only used, and only constructed, when
+	// Divergence == DivergenceFallbackRandom
+	fallback *random.Random
+
+	steps    []step
+	cursor   int
+	diverged int
+}
+
+func New() *Replay {
+	nextActionChan := make(chan signal.Action)
+	q := queue.NewBasicTBQueue()
+	r := &Replay{
+		nextActionChan: nextActionChan,
+		queue:          q,
+		queueDeqCh:     q.GetDequeueChan(),
+		TraceID:        0,
+		Divergence:     DivergenceStrict,
+	}
+	go r.dequeueEventRoutine()
+	return r
+}
+
+// returns "replay"
+func (this *Replay) Name() string {
+	return Name
+}
+
+// parameters:
+//  - traceID(int): index of the stored trace to replay (default: 0)
+//
+//  - divergencePolicy(string): one of "strict", "skip", "fallback-random";
+//    what to do when a live event does not match the next expected step
+//    of the replayed trace (default: "strict")
+//
+// when divergencePolicy is "fallback-random", every "random" policy
+// parameter (see explorepolicy/random) is also accepted and forwarded
+// to the embedded Random policy used past the point of divergence.
+func (r *Replay) LoadConfig(cfg config.Config) error {
+	policyName := cfg.GetString("explorePolicy")
+	if policyName != r.Name() {
+		log.Warnf("Policy name mismatch: \"%s\" != \"%s\"", policyName, r.Name())
+	}
+
+	epp := "explorepolicyparam."
+	if cfg.IsSet(epp + "traceID") {
+		r.TraceID = cfg.GetInt(epp + "traceID")
+		log.Infof("Set traceID=%d", r.TraceID)
+	}
+
+	if cfg.IsSet(epp + "divergencePolicy") {
+		r.Divergence = DivergencePolicy(cfg.GetString(epp + "divergencePolicy"))
+	}
+	switch r.Divergence {
+	case DivergenceStrict, DivergenceSkip:
+	case DivergenceFallbackRandom:
+		r.fallback = random.New()
+		if err := r.fallback.LoadConfig(cfg); err != nil {
+			return fmt.Errorf("replay: failed to configure fallback random policy: %s", err)
+		}
+	default:
+		return fmt.Errorf("replay: bad divergencePolicy %q", r.Divergence)
+	}
+
+	return nil
+}
+
+// SetHistoryStorage loads the trace named by TraceID and reduces it to
+// the sequence of steps makeActionForEvent will match live events
+// against.
+func (r *Replay) SetHistoryStorage(storage historystorage.HistoryStorage) error {
+	trace, err := storage.GetStoredHistory(r.TraceID)
+	if err != nil {
+		return fmt.Errorf("replay: failed to load trace %d: %s", r.TraceID, err)
+	}
+
+	r.steps = make([]step, 0, len(trace.ActionSequence))
+	for _, act := range trace.ActionSequence {
+		r.steps = append(r.steps, step{
+			entityID:    fmt.Sprintf("%v", act.Evt.EventParam["entity_id"]),
+			eventClass:  fmt.Sprintf("%v", act.Evt.EventParam["class"]),
+			eventOption: fmt.Sprintf("%v", act.Evt.EventParam["option"]),
+			actionClass: fmt.Sprintf("%v", act.ActionParam["class"]),
+		})
+	}
+	if r.fallback != nil {
+		if err := r.fallback.SetHistoryStorage(storage); err != nil {
+			return err
+		}
+	}
+	log.Infof("Loaded %d steps from trace %d for replay", len(r.steps), r.TraceID)
+	return nil
+}
+
+func (r *Replay) ActionChan() chan signal.Action {
+	return r.nextActionChan
+}
+
+// makeActionForEvent matches event against the next expected step of
+// the loaded trace by (entityID, eventClass, eventOption), and re-emits
+// the action class that was recorded for it.
+func (r *Replay) makeActionForEvent(event signal.Event) (signal.Action, error) {
+	if r.cursor >= len(r.steps) {
+		return r.handleDivergence(event, fmt.Errorf("replay: trace %d is exhausted", r.TraceID))
+	}
+
+	expected := r.steps[r.cursor]
+	// eventOption is stringified before comparison: a JSON-decoded
+	// option can be a map or slice, which would panic on "!=" otherwise.
+	eventOption := fmt.Sprintf("%v", event.EventOption())
+	if expected.entityID != event.EntityID() || expected.eventClass != event.EventClass() || expected.eventOption != eventOption {
+		return r.handleDivergence(event, fmt.Errorf(
+			"replay: event %s (entity=%s class=%s option=%v) does not match expected step %d (entity=%s class=%s option=%v)",
+			event, event.EntityID(), event.EventClass(), eventOption,
+			r.cursor, expected.entityID, expected.eventClass, expected.eventOption))
+	}
+
+	r.cursor++
+	defaultAction, defaultActionErr := event.DefaultAction()
+	faultAction, faultActionErr := event.DefaultFaultAction()
+	if faultAction != nil && faultAction.Class() == expected.actionClass {
+		return faultAction, faultActionErr
+	}
+	return defaultAction, defaultActionErr
+}
+
+func (r *Replay) handleDivergence(event signal.Event, cause error) (signal.Action, error) {
+	switch r.Divergence {
+	case DivergenceSkip:
+		log.Warnf("%s (skipping)", cause)
+		return event.DefaultAction()
+	case DivergenceFallbackRandom:
+		r.diverged++
+		log.Warnf("%s (diverged %d time(s) so far, falling back to random)", cause, r.diverged)
+		return r.fallback.MakeActionForEvent(event)
+	default:
+		panic(log.Critical(cause))
+	}
+}
+
+// dequeue event, determine corresponding action, and put the action to nextActionChan
+func (r *Replay) dequeueEventRoutine() {
+	for {
+		qItem := <-r.queueDeqCh
+		event := qItem.Value().(signal.Event)
+		action, err := r.makeActionForEvent(event)
+		log.Debugf("REPLAY: Determined action %#v for event %#v", action, event)
+		if err != nil {
+			panic(log.Critical(err))
+		}
+		r.nextActionChan <- action
+	}
+}
+
+// QueueEvent enqueues event without any interval jitter: the whole
+// point of replay is to reproduce the recorded schedule, not to
+// resample its timing.
+func (r *Replay) QueueEvent(event signal.Event) {
+	item, err := queue.NewBasicTBQueueItem(event, 0, 0)
+	if err != nil {
+		panic(log.Critical(err))
+	}
+	r.queue.Enqueue(item)
+}
@@ -0,0 +1,228 @@
+// Copyright (C) 2015 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package elasticsearch provides a HistoryStorage driver that mirrors
+// every trace recorded by naive into Elasticsearch as a document with a
+// nested "action_sequence" mapping, so traces become queryable by
+// action class, event class, and digest via Kibana. It is registered
+// as "elasticsearch".
+package elasticsearch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/osrg/earthquake/earthquake/historystorage"
+	"github.com/osrg/earthquake/earthquake/historystorage/naive"
+	"github.com/osrg/earthquake/earthquake/signal"
+	"github.com/osrg/earthquake/earthquake/util/config"
+	"github.com/osrg/earthquake/earthquake/util/metrics"
+)
+
+const (
+	defaultURL   = "http://localhost:9200"
+	defaultIndex = "earthquake"
+)
+
+// indexMapping is the nested mapping applied to the configured index's
+// "trace" type so that action_sequence.digest.* fields are queryable.
+const indexMapping = `{
+  "mappings": {
+    "trace": {
+      "properties": {
+        "action_sequence": {
+          "type": "nested",
+          "properties": {
+            "digest": {
+              "properties": {
+                "class":        { "type": "keyword" },
+                "event_class":  { "type": "keyword" },
+                "event_option": { "type": "keyword" }
+              }
+            }
+          }
+        }
+      }
+    }
+  }
+}`
+
+func init() {
+	historystorage.Register("elasticsearch", func(dirPath string, cfg config.Config) (historystorage.HistoryStorage, error) {
+		return New(dirPath, cfg)
+	})
+}
+
+// ElasticSearch implements historystorage.HistoryStorage on top of
+// naive, additionally indexing every trace into an Elasticsearch
+// cluster for ad-hoc querying (e.g. from Kibana).
+type ElasticSearch struct {
+	Naive *naive.Naive
+
+	url   string
+	index string
+	http  *http.Client
+}
+
+// parameters (all under "historyStorageParam."):
+//  - url(string): Elasticsearch base URL (default: "http://localhost:9200")
+//  - index(string): index name (default: "earthquake")
+func New(dirPath string, cfg config.Config) (*ElasticSearch, error) {
+	hsp := "historyStorageParam."
+
+	url := defaultURL
+	if cfg != nil && cfg.IsSet(hsp+"url") {
+		url = cfg.GetString(hsp + "url")
+	}
+	index := defaultIndex
+	if cfg != nil && cfg.IsSet(hsp+"index") {
+		index = cfg.GetString(hsp + "index")
+	}
+
+	es := &ElasticSearch{
+		Naive: naive.New(dirPath),
+		url:   url,
+		index: index,
+		http:  &http.Client{},
+	}
+
+	if err := es.ensureIndex(); err != nil {
+		return nil, err
+	}
+	return es, nil
+}
+
+func (this *ElasticSearch) ensureIndex() error {
+	req, err := http.NewRequest(http.MethodPut, this.url+"/"+this.index, bytes.NewBufferString(indexMapping))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := this.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to create elasticsearch index %q at %q: %s", this.index, this.url, err)
+	}
+	defer resp.Body.Close()
+	// a 400 here typically means the index already exists, which is fine
+	return nil
+}
+
+func (this *ElasticSearch) CreateStorage() {
+	this.Naive.CreateStorage()
+}
+
+func (this *ElasticSearch) Init() {
+	this.Naive.Init()
+}
+
+func (this *ElasticSearch) Close() {
+	this.Naive.Close()
+}
+
+func (this *ElasticSearch) Name() string {
+	return "elasticsearch"
+}
+
+func (this *ElasticSearch) CreateNewWorkingDir() string {
+	return this.Naive.CreateNewWorkingDir()
+}
+
+func (this *ElasticSearch) BaseDir() string {
+	return this.Naive.BaseDir()
+}
+
+func (this *ElasticSearch) RecordNewTrace(newTrace *historystorage.SingleTrace) {
+	start := time.Now()
+	defer func() {
+		metrics.TraceRecordSeconds.WithLabelValues(this.Name(), "RecordNewTrace").Observe(time.Since(start).Seconds())
+	}()
+
+	this.Naive.RecordNewTrace(newTrace)
+
+	traceID := this.Naive.NrStoredHistories() - 1
+	actionSequence := make([]map[string]interface{}, 0, len(newTrace.ActionSequence))
+	for _, act := range newTrace.ActionSequence {
+		actionSequence = append(actionSequence, map[string]interface{}{
+			"uuid": act.ActionParam["uuid"],
+			"digest": map[string]interface{}{
+				"class":        act.ActionParam["class"],
+				"event_class":  act.Evt.EventParam["class"],
+				"event_option": act.Evt.EventParam["option"],
+			},
+		})
+	}
+	doc := map[string]interface{}{
+		"trace_id":        traceID,
+		"action_sequence": actionSequence,
+	}
+
+	// Indexing into elasticsearch is best-effort: it mirrors the trace
+	// for analysis, but an outage here must not abort exploration, which
+	// is already durably recorded by this.Naive above.
+	body, err := json.Marshal(doc)
+	if err != nil {
+		log.Warnf("elasticsearch: failed to marshal trace %d: %s", traceID, err)
+		return
+	}
+	url := fmt.Sprintf("%s/%s/trace/%d", this.url, this.index, traceID)
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewBuffer(body))
+	if err != nil {
+		log.Warnf("elasticsearch: failed to build index request for trace %d: %s", traceID, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := this.http.Do(req)
+	if err != nil {
+		log.Warnf("elasticsearch: failed to index trace %d: %s", traceID, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+func (this *ElasticSearch) RecordResult(succeed bool, requiredTime time.Duration) error {
+	start := time.Now()
+	defer func() {
+		metrics.TraceRecordSeconds.WithLabelValues(this.Name(), "RecordResult").Observe(time.Since(start).Seconds())
+	}()
+	return this.Naive.RecordResult(succeed, requiredTime)
+}
+
+func (this *ElasticSearch) NrStoredHistories() int {
+	return this.Naive.NrStoredHistories()
+}
+
+func (this *ElasticSearch) GetStoredHistory(id int) (*historystorage.SingleTrace, error) {
+	return this.Naive.GetStoredHistory(id)
+}
+
+func (this *ElasticSearch) IsSucceed(id int) (bool, error) {
+	return this.Naive.IsSucceed(id)
+}
+
+func (this *ElasticSearch) GetRequiredTime(id int) (time.Duration, error) {
+	return this.Naive.GetRequiredTime(id)
+}
+
+func (this *ElasticSearch) Search(prefix []signal.Event) []int {
+	return this.Naive.Search(prefix)
+}
+
+func (this *ElasticSearch) SearchWithConverter(prefix []signal.Event, converter func(events []signal.Event) []signal.Event) []int {
+	return this.Naive.SearchWithConverter(prefix, converter)
+}
@@ -0,0 +1,97 @@
+// Copyright (C) 2015 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package historystorage defines the HistoryStorage interface used to
+// persist and query recorded traces, and a driver registry that lets a
+// backend be selected at runtime via config.Config.
+package historystorage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/osrg/earthquake/earthquake/signal"
+	"github.com/osrg/earthquake/earthquake/util/config"
+)
+
+// ActionRecord is a single (action, triggering event) pair as recorded
+// in a SingleTrace.
+type ActionRecord struct {
+	ActionType  string
+	ActionParam map[string]interface{}
+	Evt         EventRecord
+}
+
+// EventRecord is the event half of an ActionRecord.
+type EventRecord struct {
+	EventType  string
+	EventParam map[string]interface{}
+}
+
+// SingleTrace is one complete run's worth of recorded actions.
+type SingleTrace struct {
+	ActionSequence []ActionRecord
+}
+
+// HistoryStorage is implemented by every backend driver (naive, mongodb,
+// elasticsearch, postgresql, ...).
+type HistoryStorage interface {
+	CreateStorage()
+	Init()
+	Close()
+
+	Name() string
+
+	CreateNewWorkingDir() string
+	BaseDir() string
+
+	RecordNewTrace(newTrace *SingleTrace)
+	RecordResult(succeed bool, requiredTime time.Duration) error
+
+	NrStoredHistories() int
+	GetStoredHistory(id int) (*SingleTrace, error)
+	IsSucceed(id int) (bool, error)
+	GetRequiredTime(id int) (time.Duration, error)
+
+	Search(prefix []signal.Event) []int
+	SearchWithConverter(prefix []signal.Event, converter func(events []signal.Event) []signal.Event) []int
+}
+
+// Factory constructs a HistoryStorage backend from config. dirPath is the
+// on-disk working directory every driver gets, regardless of whether it
+// also talks to an external service.
+type Factory func(dirPath string, cfg config.Config) (HistoryStorage, error)
+
+var drivers = make(map[string]Factory)
+
+// Register makes a driver factory available under name. It is meant to
+// be called from a driver package's init(), mirroring the pattern used
+// by e.g. database/sql drivers.
+func Register(name string, factory Factory) {
+	if _, dup := drivers[name]; dup {
+		panic(fmt.Errorf("historystorage: Register called twice for driver %q", name))
+	}
+	drivers[name] = factory
+}
+
+// New looks up the driver registered as name (typically the
+// "historyStorage" config parameter) and constructs it.
+func New(name string, dirPath string, cfg config.Config) (HistoryStorage, error) {
+	factory, ok := drivers[name]
+	if !ok {
+		return nil, fmt.Errorf("historystorage: unknown driver %q (forgotten import?)", name)
+	}
+	return factory(dirPath, cfg)
+}
@@ -0,0 +1,215 @@
+// Copyright (C) 2015 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mongodb provides a HistoryStorage driver that mirrors every
+// trace recorded by naive into MongoDB, so traces become queryable.
+// It is registered as "mongodb".
+package mongodb
+
+import (
+	"fmt"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+
+	log "github.com/cihub/seelog"
+	"github.com/osrg/earthquake/earthquake/historystorage"
+	"github.com/osrg/earthquake/earthquake/historystorage/naive"
+	"github.com/osrg/earthquake/earthquake/signal"
+	"github.com/osrg/earthquake/earthquake/util/config"
+	"github.com/osrg/earthquake/earthquake/util/metrics"
+)
+
+const (
+	defaultDialTo        = "mongodb://localhost/earthquake"
+	defaultDBName         = "earthquake"
+	defaultActionColName = "action"
+	defaultEventColName  = "event"
+	defaultTraceColName  = "trace"
+)
+
+func init() {
+	historystorage.Register("mongodb", func(dirPath string, cfg config.Config) (historystorage.HistoryStorage, error) {
+		return New(dirPath, cfg)
+	})
+}
+
+// type that implements interface historystorage.HistoryStorage
+type MongoDB struct {
+	Naive   *naive.Naive
+	Session *mgo.Session
+	DB      *mgo.Database
+
+	actionColName string
+	eventColName  string
+	traceColName  string
+}
+
+// parameters (all under "historyStorageParam."):
+//  - dialTo(string): mongodb connection URL (default: "mongodb://localhost/earthquake")
+//  - dbName(string): database name (default: "earthquake")
+//  - actionColName(string): collection name for actions (default: "action")
+//  - eventColName(string): collection name for events (default: "event")
+//  - traceColName(string): collection name for traces (default: "trace")
+func New(dirPath string, cfg config.Config) (*MongoDB, error) {
+	hsp := "historyStorageParam."
+
+	dialTo := defaultDialTo
+	if cfg != nil && cfg.IsSet(hsp+"dialTo") {
+		dialTo = cfg.GetString(hsp + "dialTo")
+	}
+	dbName := defaultDBName
+	if cfg != nil && cfg.IsSet(hsp+"dbName") {
+		dbName = cfg.GetString(hsp + "dbName")
+	}
+	actionColName := defaultActionColName
+	if cfg != nil && cfg.IsSet(hsp+"actionColName") {
+		actionColName = cfg.GetString(hsp + "actionColName")
+	}
+	eventColName := defaultEventColName
+	if cfg != nil && cfg.IsSet(hsp+"eventColName") {
+		eventColName = cfg.GetString(hsp + "eventColName")
+	}
+	traceColName := defaultTraceColName
+	if cfg != nil && cfg.IsSet(hsp+"traceColName") {
+		traceColName = cfg.GetString(hsp + "traceColName")
+	}
+
+	session, err := mgo.Dial(dialTo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial mongodb at %q: %s", dialTo, err)
+	}
+	// Optional. Switch the session to a monotonic behavior.
+	session.SetMode(mgo.Monotonic, true)
+	db := session.DB(dbName)
+
+	return &MongoDB{
+		Naive:         naive.New(dirPath),
+		Session:       session,
+		DB:            db,
+		actionColName: actionColName,
+		eventColName:  eventColName,
+		traceColName:  traceColName,
+	}, nil
+}
+
+func (this *MongoDB) CreateStorage() {
+	this.Naive.CreateStorage()
+}
+
+func (this *MongoDB) Init() {
+	this.Naive.Init()
+}
+
+func (this *MongoDB) Close() {
+	this.Naive.Close()
+	this.Session.Close()
+}
+
+func (this *MongoDB) Name() string {
+	return "mongodb"
+}
+
+func (this *MongoDB) CreateNewWorkingDir() string {
+	d := this.Naive.CreateNewWorkingDir()
+	return d
+}
+
+func (this *MongoDB) BaseDir() string {
+	return this.Naive.BaseDir()
+}
+
+func (this *MongoDB) RecordNewTrace(newTrace *historystorage.SingleTrace) {
+	start := time.Now()
+	defer func() {
+		metrics.TraceRecordSeconds.WithLabelValues(this.Name(), "RecordNewTrace").Observe(time.Since(start).Seconds())
+	}()
+
+	this.Naive.RecordNewTrace(newTrace)
+
+	traceID := this.Naive.NrStoredHistories() - 1
+	traceDoc := map[string]interface{}{
+		// FIXME: use something like this.Naive.GetCurrentTraceID()
+		"trace_id": traceID,
+	}
+	// Mirroring into mongodb is best-effort: it's a copy for querying,
+	// but an outage here must not abort exploration, which is already
+	// durably recorded by this.Naive above.
+	actionSequence := make([]map[string]interface{}, 0)
+	for _, act := range newTrace.ActionSequence {
+		if act.ActionType != "_JSON" || act.ActionParam["type"] != "action" ||
+			act.Evt.EventType != "_JSON" || act.Evt.EventParam["type"] != "event" {
+			panic(fmt.Errorf("bad action %v", act))
+		}
+		if err := this.DB.C(this.actionColName).Insert(&act.ActionParam); err != nil {
+			log.Warnf("mongodb: failed to insert action for trace %d: %s", traceID, err)
+		}
+		if err := this.DB.C(this.eventColName).Insert(&act.Evt.EventParam); err != nil {
+			log.Warnf("mongodb: failed to insert event for trace %d: %s", traceID, err)
+		}
+		actionSequence = append(actionSequence, map[string]interface{}{
+			// TODO: consider mongodb ObjectID
+			"uuid": act.ActionParam["uuid"],
+			// TODO: use ActionParam["digest"] if set (digest computation can be off-loaded to pyearthquake)
+			"digest": map[string]interface{}{
+				"class":        act.ActionParam["class"],
+				"event_class":  act.Evt.EventParam["class"],
+				"event_option": act.Evt.EventParam["option"],
+			},
+		})
+	}
+	traceDoc["action_sequence"] = actionSequence
+	if err := this.DB.C(this.traceColName).Insert(&traceDoc); err != nil {
+		log.Warnf("mongodb: failed to insert trace %d: %s", traceID, err)
+	}
+}
+
+func (this *MongoDB) RecordResult(succeed bool, requiredTime time.Duration) error {
+	start := time.Now()
+	defer func() {
+		metrics.TraceRecordSeconds.WithLabelValues(this.Name(), "RecordResult").Observe(time.Since(start).Seconds())
+	}()
+	return this.Naive.RecordResult(succeed, requiredTime)
+}
+
+func (this *MongoDB) NrStoredHistories() int {
+	nr := this.Naive.NrStoredHistories()
+	return nr
+}
+
+func (this *MongoDB) GetStoredHistory(id int) (*historystorage.SingleTrace, error) {
+	trace, err := this.Naive.GetStoredHistory(id)
+	return trace, err
+}
+
+func (this *MongoDB) IsSucceed(id int) (bool, error) {
+	succ, err := this.Naive.IsSucceed(id)
+	return succ, err
+}
+
+func (this *MongoDB) GetRequiredTime(id int) (time.Duration, error) {
+	t, err := this.Naive.GetRequiredTime(id)
+	return t, err
+}
+
+func (this *MongoDB) Search(prefix []signal.Event) []int {
+	slice := this.Naive.Search(prefix)
+	return slice
+}
+
+func (this *MongoDB) SearchWithConverter(prefix []signal.Event, converter func(events []signal.Event) []signal.Event) []int {
+	slice := this.Naive.SearchWithConverter(prefix, converter)
+	return slice
+}
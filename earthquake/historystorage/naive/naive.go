@@ -0,0 +1,205 @@
+// Copyright (C) 2015 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package naive provides the default HistoryStorage driver, which keeps
+// every trace as a JSON file under a plain directory tree. It requires
+// no external service and is registered as "naive".
+package naive
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/osrg/earthquake/earthquake/historystorage"
+	"github.com/osrg/earthquake/earthquake/signal"
+	"github.com/osrg/earthquake/earthquake/util/config"
+	"github.com/osrg/earthquake/earthquake/util/metrics"
+)
+
+func init() {
+	historystorage.Register("naive", func(dirPath string, cfg config.Config) (historystorage.HistoryStorage, error) {
+		return New(dirPath), nil
+	})
+}
+
+type traceMeta struct {
+	Succeed      bool
+	RequiredTime time.Duration
+}
+
+// Naive implements historystorage.HistoryStorage on top of a plain
+// directory tree: baseDir/<id>/trace.json and baseDir/<id>/meta.json.
+type Naive struct {
+	baseDir string
+}
+
+func New(dirPath string) *Naive {
+	return &Naive{baseDir: dirPath}
+}
+
+func (this *Naive) CreateStorage() {
+	if err := os.MkdirAll(this.baseDir, 0755); err != nil {
+		panic(err)
+	}
+}
+
+func (this *Naive) Init() {
+}
+
+func (this *Naive) Close() {
+}
+
+func (this *Naive) Name() string {
+	return "naive"
+}
+
+// BaseDir returns the storage's root directory without creating or
+// mutating anything, unlike CreateNewWorkingDir.
+func (this *Naive) BaseDir() string {
+	return this.baseDir
+}
+
+func (this *Naive) CreateNewWorkingDir() string {
+	d := filepath.Join(this.baseDir, fmt.Sprintf("%d", this.NrStoredHistories()))
+	if err := os.MkdirAll(d, 0755); err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func (this *Naive) RecordNewTrace(newTrace *historystorage.SingleTrace) {
+	start := time.Now()
+	defer func() {
+		metrics.TraceRecordSeconds.WithLabelValues(this.Name(), "RecordNewTrace").Observe(time.Since(start).Seconds())
+	}()
+
+	d := this.CreateNewWorkingDir()
+	f, err := os.Create(filepath.Join(d, "trace.json"))
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(newTrace); err != nil {
+		panic(err)
+	}
+}
+
+func (this *Naive) RecordResult(succeed bool, requiredTime time.Duration) error {
+	start := time.Now()
+	defer func() {
+		metrics.TraceRecordSeconds.WithLabelValues(this.Name(), "RecordResult").Observe(time.Since(start).Seconds())
+	}()
+
+	d := filepath.Join(this.baseDir, fmt.Sprintf("%d", this.NrStoredHistories()-1))
+	f, err := os.Create(filepath.Join(d, "meta.json"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(traceMeta{Succeed: succeed, RequiredTime: requiredTime})
+}
+
+func (this *Naive) NrStoredHistories() int {
+	entries, err := os.ReadDir(this.baseDir)
+	if err != nil {
+		return 0
+	}
+	nr := 0
+	for _, e := range entries {
+		if e.IsDir() {
+			nr++
+		}
+	}
+	return nr
+}
+
+func (this *Naive) GetStoredHistory(id int) (*historystorage.SingleTrace, error) {
+	path := filepath.Join(this.baseDir, fmt.Sprintf("%d", id), "trace.json")
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var trace historystorage.SingleTrace
+	if err := json.NewDecoder(f).Decode(&trace); err != nil {
+		return nil, err
+	}
+	return &trace, nil
+}
+
+func (this *Naive) IsSucceed(id int) (bool, error) {
+	meta, err := this.getMeta(id)
+	if err != nil {
+		return false, err
+	}
+	return meta.Succeed, nil
+}
+
+func (this *Naive) GetRequiredTime(id int) (time.Duration, error) {
+	meta, err := this.getMeta(id)
+	if err != nil {
+		return 0, err
+	}
+	return meta.RequiredTime, nil
+}
+
+func (this *Naive) getMeta(id int) (*traceMeta, error) {
+	path := filepath.Join(this.baseDir, fmt.Sprintf("%d", id), "meta.json")
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var meta traceMeta
+	if err := json.NewDecoder(f).Decode(&meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// Search returns the ids of every stored trace, in order, when prefix is
+// empty. Recorded events are not compared against a non-empty prefix;
+// for one, it returns no ids.
+func (this *Naive) Search(prefix []signal.Event) []int {
+	return this.SearchWithConverter(prefix, func(events []signal.Event) []signal.Event {
+		return events
+	})
+}
+
+func (this *Naive) SearchWithConverter(prefix []signal.Event, converter func(events []signal.Event) []signal.Event) []int {
+	// TODO: matching against the converted event sequence requires
+	// reconstructing signal.Event values from the recorded EventRecord
+	// JSON, which is out of naive's scope for now.
+	_ = converter
+	found := make([]int, 0)
+	nr := this.NrStoredHistories()
+	ids := make([]int, 0, nr)
+	for i := 0; i < nr; i++ {
+		ids = append(ids, i)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		if len(prefix) == 0 {
+			found = append(found, id)
+		}
+	}
+	return found
+}
@@ -0,0 +1,197 @@
+// Copyright (C) 2015 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package postgresql provides a HistoryStorage driver that mirrors every
+// trace recorded by naive into a normalized PostgreSQL schema (traces,
+// actions, events tables with foreign keys), for SQL-based analysis. It
+// is registered as "postgresql".
+package postgresql
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	_ "github.com/lib/pq"
+
+	log "github.com/cihub/seelog"
+	"github.com/osrg/earthquake/earthquake/historystorage"
+	"github.com/osrg/earthquake/earthquake/historystorage/naive"
+	"github.com/osrg/earthquake/earthquake/signal"
+	"github.com/osrg/earthquake/earthquake/util/config"
+	"github.com/osrg/earthquake/earthquake/util/metrics"
+)
+
+const defaultConnStr = "postgres://localhost/earthquake?sslmode=disable"
+
+const schemaDDL = `
+CREATE TABLE IF NOT EXISTS traces (
+	id         SERIAL PRIMARY KEY,
+	trace_id   INTEGER NOT NULL UNIQUE
+);
+CREATE TABLE IF NOT EXISTS events (
+	id          SERIAL PRIMARY KEY,
+	trace_id    INTEGER NOT NULL REFERENCES traces(trace_id),
+	event_class TEXT,
+	param       JSONB
+);
+CREATE TABLE IF NOT EXISTS actions (
+	id           SERIAL PRIMARY KEY,
+	trace_id     INTEGER NOT NULL REFERENCES traces(trace_id),
+	event_id     INTEGER NOT NULL REFERENCES events(id),
+	action_class TEXT,
+	param        JSONB
+);
+`
+
+func init() {
+	historystorage.Register("postgresql", func(dirPath string, cfg config.Config) (historystorage.HistoryStorage, error) {
+		return New(dirPath, cfg)
+	})
+}
+
+// PostgreSQL implements historystorage.HistoryStorage on top of naive,
+// additionally mirroring every trace into a normalized PostgreSQL schema.
+type PostgreSQL struct {
+	Naive *naive.Naive
+	DB    *sql.DB
+}
+
+// parameters (all under "historyStorageParam."):
+//  - connStr(string): PostgreSQL connection string
+//    (default: "postgres://localhost/earthquake?sslmode=disable")
+func New(dirPath string, cfg config.Config) (*PostgreSQL, error) {
+	connStr := defaultConnStr
+	if cfg != nil && cfg.IsSet("historyStorageParam.connStr") {
+		connStr = cfg.GetString("historyStorageParam.connStr")
+	}
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open postgresql connection %q: %s", connStr, err)
+	}
+	if _, err := db.Exec(schemaDDL); err != nil {
+		return nil, fmt.Errorf("failed to create postgresql schema: %s", err)
+	}
+
+	return &PostgreSQL{
+		Naive: naive.New(dirPath),
+		DB:    db,
+	}, nil
+}
+
+func (this *PostgreSQL) CreateStorage() {
+	this.Naive.CreateStorage()
+}
+
+func (this *PostgreSQL) Init() {
+	this.Naive.Init()
+}
+
+func (this *PostgreSQL) Close() {
+	this.Naive.Close()
+	this.DB.Close()
+}
+
+func (this *PostgreSQL) Name() string {
+	return "postgresql"
+}
+
+func (this *PostgreSQL) CreateNewWorkingDir() string {
+	return this.Naive.CreateNewWorkingDir()
+}
+
+func (this *PostgreSQL) BaseDir() string {
+	return this.Naive.BaseDir()
+}
+
+func (this *PostgreSQL) RecordNewTrace(newTrace *historystorage.SingleTrace) {
+	start := time.Now()
+	defer func() {
+		metrics.TraceRecordSeconds.WithLabelValues(this.Name(), "RecordNewTrace").Observe(time.Since(start).Seconds())
+	}()
+
+	this.Naive.RecordNewTrace(newTrace)
+
+	// Mirroring into postgresql is best-effort: it's a normalized copy
+	// for SQL analysis, but an outage here must not abort exploration,
+	// which is already durably recorded by this.Naive above.
+	traceID := this.Naive.NrStoredHistories() - 1
+	if _, err := this.DB.Exec(`INSERT INTO traces(trace_id) VALUES ($1)`, traceID); err != nil {
+		log.Warnf("postgresql: failed to insert trace %d: %s", traceID, err)
+		return
+	}
+
+	for _, act := range newTrace.ActionSequence {
+		eventParam, err := json.Marshal(act.Evt.EventParam)
+		if err != nil {
+			log.Warnf("postgresql: failed to marshal event param for trace %d: %s", traceID, err)
+			continue
+		}
+		var eventID int64
+		row := this.DB.QueryRow(
+			`INSERT INTO events(trace_id, event_class, param) VALUES ($1, $2, $3) RETURNING id`,
+			traceID, act.Evt.EventParam["class"], eventParam)
+		if err := row.Scan(&eventID); err != nil {
+			log.Warnf("postgresql: failed to insert event for trace %d: %s", traceID, err)
+			continue
+		}
+
+		actionParam, err := json.Marshal(act.ActionParam)
+		if err != nil {
+			log.Warnf("postgresql: failed to marshal action param for trace %d: %s", traceID, err)
+			continue
+		}
+		if _, err := this.DB.Exec(
+			`INSERT INTO actions(trace_id, event_id, action_class, param) VALUES ($1, $2, $3, $4)`,
+			traceID, eventID, act.ActionParam["class"], actionParam); err != nil {
+			log.Warnf("postgresql: failed to insert action for trace %d: %s", traceID, err)
+			continue
+		}
+	}
+}
+
+func (this *PostgreSQL) RecordResult(succeed bool, requiredTime time.Duration) error {
+	start := time.Now()
+	defer func() {
+		metrics.TraceRecordSeconds.WithLabelValues(this.Name(), "RecordResult").Observe(time.Since(start).Seconds())
+	}()
+	return this.Naive.RecordResult(succeed, requiredTime)
+}
+
+func (this *PostgreSQL) NrStoredHistories() int {
+	return this.Naive.NrStoredHistories()
+}
+
+func (this *PostgreSQL) GetStoredHistory(id int) (*historystorage.SingleTrace, error) {
+	return this.Naive.GetStoredHistory(id)
+}
+
+func (this *PostgreSQL) IsSucceed(id int) (bool, error) {
+	return this.Naive.IsSucceed(id)
+}
+
+func (this *PostgreSQL) GetRequiredTime(id int) (time.Duration, error) {
+	return this.Naive.GetRequiredTime(id)
+}
+
+func (this *PostgreSQL) Search(prefix []signal.Event) []int {
+	return this.Naive.Search(prefix)
+}
+
+func (this *PostgreSQL) SearchWithConverter(prefix []signal.Event, converter func(events []signal.Event) []signal.Event) []int {
+	return this.Naive.SearchWithConverter(prefix, converter)
+}
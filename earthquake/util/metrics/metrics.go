@@ -0,0 +1,181 @@
+// Copyright (C) 2015 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics exposes Prometheus counters/histograms for policy
+// decisions and queue behavior over a "/metrics" HTTP endpoint, and
+// holds the global OpenTracing tracer used to span policy decisions.
+// Both are no-ops until Init
+// is called with a config.Config that actually configures them.
+package metrics
+
+import (
+	"fmt"
+	log "github.com/cihub/seelog"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/osrg/earthquake/earthquake/util/config"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	ActionsDispatched = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "earthquake",
+		Name:      "actions_dispatched_total",
+		Help:      "Number of actions dispatched by an explore policy.",
+	}, []string{"policy", "action_class", "fault_injected"})
+
+	EventsQueued = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "earthquake",
+		Name:      "events_queued_total",
+		Help:      "Number of events queued for a decision.",
+	}, []string{"policy"})
+
+	EventsDequeued = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "earthquake",
+		Name:      "events_dequeued_total",
+		Help:      "Number of events dequeued for a decision.",
+	}, []string{"policy"})
+
+	QueueWaitSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "earthquake",
+		Name:      "queue_wait_seconds",
+		Help:      "Time an event spent in the time-bounded queue before being dequeued.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"policy"})
+
+	ShellFaultInjections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "earthquake",
+		Name:      "shell_fault_injections_total",
+		Help:      "Number of times shellFaultInjectionRoutine fired a ShellAction.",
+	}, []string{"policy"})
+
+	TraceRecordSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "earthquake",
+		Name:      "trace_record_seconds",
+		Help:      "Latency of HistoryStorage.RecordNewTrace/RecordResult.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"storage", "method"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		ActionsDispatched,
+		EventsQueued,
+		EventsDequeued,
+		QueueWaitSeconds,
+		ShellFaultInjections,
+		TraceRecordSeconds,
+	)
+}
+
+// Tracer is the global OpenTracing tracer that StartDecisionSpan starts
+// spans on. It defaults to a no-op tracer until Init configures one.
+var Tracer opentracing.Tracer = opentracing.NoopTracer{}
+
+var enabled bool
+
+// Enabled reports whether Init started the "/metrics" endpoint.
+func Enabled() bool {
+	return enabled
+}
+
+// Init starts the Prometheus "/metrics" HTTP endpoint and installs the
+// global tracer, both driven by config.Config. It is a clean no-op when
+// neither "metricsPort" nor "tracer" is set.
+//
+// parameters:
+//  - metricsPort(int): TCP port to serve "/metrics" on (default: disabled)
+//  - tracer(string): name of the OpenTracing tracer to install as the
+//    global Tracer; only "noop" and "" are recognised, and any other name
+//    makes Init return an error (default: disabled, i.e. NoopTracer)
+func Init(cfg config.Config) error {
+	if cfg.IsSet("metricsPort") {
+		port := cfg.GetInt("metricsPort")
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		addr := ":" + strconv.Itoa(port)
+		go func() {
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				log.Criticalf("metrics: /metrics endpoint on %s failed: %s", addr, err)
+			}
+		}()
+		enabled = true
+		log.Infof("metrics: serving /metrics on %s", addr)
+	} else {
+		log.Info("metrics: metricsPort not set, /metrics endpoint disabled")
+	}
+
+	if cfg.IsSet("tracer") {
+		name := cfg.GetString("tracer")
+		tracer, err := newTracer(name)
+		if err != nil {
+			return fmt.Errorf("metrics: failed to create tracer %q: %s", name, err)
+		}
+		Tracer = tracer
+		opentracing.SetGlobalTracer(tracer)
+		log.Infof("metrics: installed tracer %q", name)
+	} else {
+		log.Info("metrics: tracer not set, tracing disabled")
+	}
+
+	return nil
+}
+
+// newTracer resolves name to a concrete opentracing.Tracer.
+// TODO: support more than the no-op tracer once a concrete backend
+// (Jaeger, Zipkin, ...) is chosen for this project.
+func newTracer(name string) (opentracing.Tracer, error) {
+	switch name {
+	case "noop", "":
+		return opentracing.NoopTracer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown tracer %q", name)
+	}
+}
+
+// SpanComments returns span's SpanContext, formatted with "%v", under the
+// key "opentracing_span_context", as a comments map suitable for merging
+// into the map passed to signal.NewShellAction. No trace or span ID is
+// extracted from the context separately.
+func SpanComments(span opentracing.Span) map[string]interface{} {
+	if span == nil {
+		return nil
+	}
+	ctx := span.Context()
+	return map[string]interface{}{
+		"opentracing_span_context": fmt.Sprintf("%v", ctx),
+	}
+}
+
+// StartDecisionSpan starts a span named "<policy>.decision" on Tracer,
+// tagged with the given policy and event class. The span covers only what
+// the caller does before finishing it; it does not include the time the
+// event spent queued before the call.
+func StartDecisionSpan(policy, eventClass string) opentracing.Span {
+	return Tracer.StartSpan(
+		fmt.Sprintf("%s.decision", policy),
+		opentracing.Tag{Key: "policy", Value: policy},
+		opentracing.Tag{Key: "event_class", Value: eventClass},
+	)
+}
+
+// ObserveQueueWait records how long an item spent in a policy's
+// time-bounded queue before being dequeued.
+func ObserveQueueWait(policy string, waited time.Duration) {
+	QueueWaitSeconds.WithLabelValues(policy).Observe(waited.Seconds())
+}